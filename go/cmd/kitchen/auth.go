@@ -0,0 +1,276 @@
+// Copyright (c) 2016 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang/go/src/io/ioutil"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// tokenScope is the OAuth scope minted for -service-account-json.
+const tokenScope = "https://www.googleapis.com/auth/gerritcodereview"
+
+// hostOf returns the host component of a repository URL.
+func hostOf(repoURL string) (string, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid repository %q: %s", repoURL, err)
+	}
+	return u.Host, nil
+}
+
+// gitAuthArgs returns extra global "-c" git arguments that authenticate
+// requests to host, preferring (in order) a minted service account token, a
+// .netrc entry and a git-cookies entry. It returns a nil slice if none of
+// those have credentials for host.
+func gitAuthArgs(c context.Context, host, serviceAccountJSON string) ([]string, error) {
+	var args []string
+
+	if serviceAccountJSON != "" {
+		token, err := mintServiceAccountToken(c, serviceAccountJSON)
+		if err != nil {
+			return nil, fmt.Errorf("minting service account token: %s", err)
+		}
+		args = append(args, "-c", "http.extraHeader=Authorization: Bearer "+token)
+		return args, nil
+	}
+
+	if login, password, ok, err := netrcCredentials(host); err != nil {
+		return nil, err
+	} else if ok {
+		basic := base64.StdEncoding.EncodeToString([]byte(login + ":" + password))
+		args = append(args, "-c", "http.extraHeader=Authorization: Basic "+basic)
+		return args, nil
+	}
+
+	if cookiePath, err := gitCookieFilePath(); err != nil {
+		return nil, err
+	} else if cookiePath != "" {
+		if name, value, ok, err := cookieFileCredentials(cookiePath, host); err != nil {
+			return nil, err
+		} else if ok {
+			args = append(args, "-c", "http.extraHeader=Cookie: "+name+"="+value)
+		}
+	}
+
+	return args, nil
+}
+
+// netrcCredentials looks up a login/password pair for host in $HOME/.netrc.
+func netrcCredentials(host string) (login, password string, ok bool, err error) {
+	home := os.Getenv("HOME")
+	if home == "" {
+		return "", "", false, nil
+	}
+	data, err := ioutil.ReadFile(home + "/.netrc")
+	if os.IsNotExist(err) {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+
+	// .netrc is a whitespace-separated token stream, not line-oriented:
+	// "machine <host> login <login> password <password>".
+	tokens := strings.Fields(string(data))
+	for i := 0; i < len(tokens); i++ {
+		if tokens[i] != "machine" || i+1 >= len(tokens) || tokens[i+1] != host {
+			continue
+		}
+		entry := tokens[i+2:]
+		for j := 0; j+1 < len(entry) && entry[j] != "machine" && entry[j] != "default"; j += 2 {
+			switch entry[j] {
+			case "login":
+				login = entry[j+1]
+			case "password":
+				password = entry[j+1]
+			}
+		}
+		if login != "" || password != "" {
+			return login, password, true, nil
+		}
+	}
+	return "", "", false, nil
+}
+
+// gitCookieFilePath returns the path configured as git's http.cookiefile, or
+// "" if none is configured.
+func gitCookieFilePath() (string, error) {
+	out, err := exec.Command("git", "config", "--get", "http.cookiefile").Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			// Not configured.
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// cookieFileCredentials looks up a cookie for host in a Netscape-format
+// cookie file, such as one produced by `git-cookie-authdaemon`. Site-wide
+// entries (domain ".example.com") match any host within that domain.
+func cookieFileCredentials(path, host string) (name, value string, ok bool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", "", false, nil
+	}
+	if err != nil {
+		return "", "", false, err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			continue
+		}
+		domain := fields[0]
+		if !cookieDomainMatches(domain, host) {
+			continue
+		}
+		return fields[5], fields[6], true, nil
+	}
+	return "", "", false, nil
+}
+
+// cookieDomainMatches reports whether a cookie's domain field applies to
+// host, honoring the ".example.com" wildcard convention for site-wide
+// cookies.
+func cookieDomainMatches(domain, host string) bool {
+	if domain == host {
+		return true
+	}
+	if strings.HasPrefix(domain, ".") {
+		bare := domain[1:]
+		return host == bare || strings.HasSuffix(host, domain)
+	}
+	return false
+}
+
+// serviceAccountKey is the subset of a Google service account JSON key file
+// needed to mint an OAuth2 access token via the JWT bearer flow.
+type serviceAccountKey struct {
+	ClientEmail string `json:"client_email"`
+	PrivateKey  string `json:"private_key"`
+	TokenURI    string `json:"token_uri"`
+}
+
+// mintServiceAccountToken mints a short-lived OAuth2 access token for the
+// service account described by the JSON key file at path, using the JWT
+// bearer grant.
+func mintServiceAccountToken(c context.Context, path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("reading service account key %q: %s", path, err)
+	}
+	key := &serviceAccountKey{}
+	if err := json.Unmarshal(data, key); err != nil {
+		return "", fmt.Errorf("parsing service account key %q: %s", path, err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = "https://www.googleapis.com/oauth2/v4/token"
+	}
+
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("service account key %q has no PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("parsing private key in %q: %s", path, err)
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("private key in %q is not RSA", path)
+	}
+
+	assertion, err := signJWT(key.ClientEmail, key.TokenURI, tokenScope, privateKey)
+	if err != nil {
+		return "", fmt.Errorf("signing JWT assertion: %s", err)
+	}
+
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	resp, err := ctxhttp.PostForm(c, http.DefaultClient, key.TokenURI, form)
+	if err != nil {
+		return "", fmt.Errorf("requesting token: %s", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading token response: %s", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("requesting token: HTTP %d: %s", resp.StatusCode, body)
+	}
+
+	var tokenResp struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(body, &tokenResp); err != nil {
+		return "", fmt.Errorf("parsing token response: %s", err)
+	}
+	if tokenResp.AccessToken == "" {
+		return "", fmt.Errorf("token response has no access_token")
+	}
+	return tokenResp.AccessToken, nil
+}
+
+// signJWT builds and signs a JWT bearer assertion for the jwt-bearer OAuth2
+// grant, valid for one hour.
+func signJWT(issuer, audience, scope string, key *rsa.PrivateKey) (string, error) {
+	now := time.Now()
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	claims := map[string]interface{}{
+		"iss":   issuer,
+		"scope": scope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(headerJSON) + "." +
+		base64.RawURLEncoding.EncodeToString(claimsJSON)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
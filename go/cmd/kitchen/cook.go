@@ -12,6 +12,7 @@ import (
 	"path"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/golang/go/src/io/ioutil"
 	"github.com/luci/luci-go/common/ctxcmd"
@@ -36,6 +37,46 @@ var cmdCook = &subcommands.Command{
 			"FETCH_HEAD",
 			"Git commit hash to check out.")
 		fs.StringVar(&c.Recipe, "recipe", "<recipe>", "Name of the recipe to run")
+		fs.StringVar(
+			&c.IntegrationRemote,
+			"integration-remote",
+			"",
+			"Gitiles URL of an integration repository to fetch an integration "+
+				"manifest from. If set, -repository and -revision are resolved "+
+				"from the manifest instead of being required directly.")
+		fs.StringVar(
+			&c.IntegrationRef,
+			"integration-ref",
+			"refs/heads/master",
+			"Ref of the integration repository to fetch the manifest from. "+
+				"Ignored if -cl is set.")
+		fs.StringVar(
+			&c.ManifestPath,
+			"manifest-path",
+			"recipes.cfg",
+			"Path within the integration repository of the manifest file.")
+		fs.StringVar(
+			&c.CL,
+			"cl",
+			"",
+			"A Gerrit change, as a URL or host:change-number. If set, the "+
+				"integration manifest is read from that Gerrit host at the "+
+				"change's current patchset instead of from -integration-remote "+
+				"at -integration-ref.")
+		fs.StringVar(
+			&c.ServiceAccountJSON,
+			"service-account-json",
+			"",
+			"Path to a service account JSON key file to mint an OAuth2 token "+
+				"for authenticated git operations, instead of .netrc or "+
+				"git-cookies.")
+		fs.StringVar(
+			&c.BuildbucketBuild,
+			"buildbucket-build",
+			"",
+			"Path to a JSON file containing a buildbucket Build message. If its "+
+				"input references a gitiles commit, that commit takes precedence "+
+				"over the integration manifest's pinned revision.")
 		fs.StringVar(
 			&c.CheckoutDir,
 			"checkout-dir",
@@ -47,6 +88,23 @@ var cmdCook = &subcommands.Command{
 			"workdir",
 			"",
 			"The working directory for recipe execution. Defaults to a temp dir.")
+		fs.DurationVar(
+			&c.CheckoutTimeout,
+			"checkout-timeout",
+			5*time.Minute,
+			"Maximum duration of the checkout phase, separate from the recipe's own run time.")
+		fs.StringVar(
+			&c.Layout,
+			"layout",
+			"",
+			"Path to a YAML/JSON file describing additional git repositories to "+
+				"assemble into the checkout, pinned to specific revisions, before "+
+				"the recipe runs.")
+		fs.StringVar(
+			&c.LayoutCacheDir,
+			"layout-cache-dir",
+			"kitchen-layout-cache",
+			"Directory to cache repositories checked out for -layout entries.")
 		fs.StringVar(&c.Properties, "properties", "", "A json string containing the properties")
 		fs.StringVar(&c.PropertiesFile, "properties-file", "", "A file containing a json blob of properties")
 		fs.StringVar(
@@ -64,7 +122,16 @@ type cookRun struct {
 	RepositoryURL        string
 	Revision             string
 	Recipe               string
+	IntegrationRemote    string
+	IntegrationRef       string
+	ManifestPath         string
+	CL                   string
+	ServiceAccountJSON   string
+	BuildbucketBuild     string
 	CheckoutDir          string
+	CheckoutTimeout      time.Duration
+	Layout               string
+	LayoutCacheDir       string
 	Workdir              string
 	Properties           string
 	PropertiesFile       string
@@ -72,17 +139,30 @@ type cookRun struct {
 }
 
 func (c *cookRun) validateFlags() error {
-	// Validate Repository.
-	if c.RepositoryURL == "" {
-		return fmt.Errorf("-repository is required")
-	}
-	repoURL, err := url.Parse(c.RepositoryURL)
-	if err != nil {
-		return fmt.Errorf("invalid repository %q: %s", repoURL, err)
-	}
-	repoName := path.Base(repoURL.Path)
-	if repoName == "" {
-		return fmt.Errorf("invalid repository %q: no path", repoURL)
+	// Validate Repository. If -integration-remote is set, -repository and
+	// -revision are resolved later, from the integration manifest.
+	if c.IntegrationRemote == "" {
+		if c.CL != "" {
+			return fmt.Errorf("-cl requires -integration-remote")
+		}
+		if c.BuildbucketBuild != "" {
+			return fmt.Errorf("-buildbucket-build requires -integration-remote")
+		}
+		if c.RepositoryURL == "" {
+			return fmt.Errorf("-repository is required")
+		}
+		repoURL, err := url.Parse(c.RepositoryURL)
+		if err != nil {
+			return fmt.Errorf("invalid repository %q: %s", repoURL, err)
+		}
+		repoName := path.Base(repoURL.Path)
+		if repoName == "" {
+			return fmt.Errorf("invalid repository %q: no path", repoURL)
+		}
+		// Fix CheckoutDir.
+		if c.CheckoutDir == "" {
+			c.CheckoutDir = repoName
+		}
 	}
 
 	// Validate Recipe.
@@ -90,16 +170,39 @@ func (c *cookRun) validateFlags() error {
 		return fmt.Errorf("-recipe is required")
 	}
 
-	// Fix CheckoutDir.
-	if c.CheckoutDir == "" {
-		c.CheckoutDir = repoName
-	}
 	return nil
 }
 
 // run checks out a repo, runs a recipe and returns exit code.
 func (c *cookRun) run(ctx context.Context) (recipeExitCode int, err error) {
-	if err = checkoutRepository(ctx, c.CheckoutDir, c.RepositoryURL, c.Revision); err != nil {
+	// -checkout-timeout bounds the whole bootstrap-through-checkout sequence,
+	// including integration manifest and Gerrit resolution, not just the git
+	// checkout itself.
+	checkoutCtx, cancel := context.WithTimeout(ctx, c.CheckoutTimeout)
+	defer cancel()
+
+	if err = c.resolveIntegration(checkoutCtx); err != nil {
+		return 0, err
+	}
+	if c.CheckoutDir == "" {
+		repoURL, err := url.Parse(c.RepositoryURL)
+		if err != nil {
+			return 0, fmt.Errorf("invalid repository %q: %s", c.RepositoryURL, err)
+		}
+		if c.CheckoutDir = path.Base(repoURL.Path); c.CheckoutDir == "" {
+			return 0, fmt.Errorf("invalid repository %q: no path", c.RepositoryURL)
+		}
+	}
+
+	repoClient, err := newRepoClient(c.RepositoryURL, c.ServiceAccountJSON)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err = repoClient.Fetch(checkoutCtx, c.CheckoutDir, c.Revision); err != nil {
+		return 0, err
+	}
+	if err = c.applyLayout(checkoutCtx); err != nil {
 		return 0, err
 	}
 
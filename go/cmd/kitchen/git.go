@@ -15,9 +15,14 @@ import (
 	"golang.org/x/net/context"
 )
 
-// clone clones a Git repo.
-func clone(c context.Context, repoUrl, workdir string) error {
-	return runGit(c, "", "clone", repoUrl, workdir)
+// clone clones a Git repo, authenticating to host using serviceAccountJSON,
+// .netrc or git-cookies, in that order of preference.
+func clone(c context.Context, repoUrl, workdir, serviceAccountJSON string) error {
+	authArgs, err := authArgsForRepo(c, repoUrl, serviceAccountJSON)
+	if err != nil {
+		return err
+	}
+	return runGitWithRetry(c, "", authArgs, "clone", repoUrl, workdir)
 }
 
 // cloneOrFetch ensures that workdir is a git directory
@@ -26,13 +31,13 @@ func clone(c context.Context, repoUrl, workdir string) error {
 // If workdir is a non-empty non-git directory
 // or if it is a git directory with a different repository URL
 // cloneOrFetch returns an error.
-func cloneOrFetch(c context.Context, workdir, repoURL string) error {
+func cloneOrFetch(c context.Context, workdir, repoURL, serviceAccountJSON string) error {
 	if _, err := os.Stat(workdir); os.IsNotExist(err) {
-		return clone(c, repoURL, workdir)
+		return clone(c, repoURL, workdir, serviceAccountJSON)
 	}
 
 	// Is it a Git repo?
-	if err := git(workdir, "rev-parse").Run(c); err != nil {
+	if err := git(workdir, nil, "rev-parse").Run(c); err != nil {
 		if _, ok := err.(*exec.ExitError); !ok {
 			return err
 		}
@@ -49,11 +54,11 @@ func cloneOrFetch(c context.Context, workdir, repoURL string) error {
 		if len(files) > 0 {
 			return fmt.Errorf("workdir %q is a non-git non-empty directory.", workdir)
 		}
-		return clone(c, repoURL, workdir)
+		return clone(c, repoURL, workdir, serviceAccountJSON)
 	}
 
 	// Is origin's URL same?
-	originUrlBytes, err := git(workdir, "config", "remote.origin.url").Output()
+	originUrlBytes, err := git(workdir, nil, "config", "remote.origin.url").Output()
 	if err != nil {
 		return err
 	}
@@ -62,13 +67,19 @@ func cloneOrFetch(c context.Context, workdir, repoURL string) error {
 		return fmt.Errorf("workdir %q is a git repository with a different origin url: %q != %q", workdir, originUrl, repoURL)
 	}
 
-	return runGit(c, workdir, "fetch", "origin")
+	authArgs, err := authArgsForRepo(c, repoURL, serviceAccountJSON)
+	if err != nil {
+		return err
+	}
+	return runGitWithRetry(c, workdir, authArgs, "fetch", "origin")
 }
 
 // checkoutRepository checks out repository at revision to workdir.
 // If workdir doesn't exist, clones the repo, otherwise tries to fetch.
-func checkoutRepository(c context.Context, workdir, repository, revision string) error {
-	if err := cloneOrFetch(c, workdir, repository); err != nil {
+// serviceAccountJSON, if not empty, is used to authenticate network git
+// operations instead of .netrc or git-cookies.
+func checkoutRepository(c context.Context, workdir, repository, revision, serviceAccountJSON string) error {
+	if err := cloneOrFetch(c, workdir, repository, serviceAccountJSON); err != nil {
 		return err
 	}
 
@@ -83,12 +94,25 @@ func checkoutRepository(c context.Context, workdir, repository, revision string)
 			return nil
 		}
 	}
-	return runGit(c, workdir, "checkout", revision)
+	return runGit(c, workdir, nil, "checkout", revision)
+}
+
+// authArgsForRepo resolves the host of repoURL and returns the extra global
+// git arguments needed to authenticate to it.
+func authArgsForRepo(c context.Context, repoURL, serviceAccountJSON string) ([]string, error) {
+	host, err := hostOf(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	return gitAuthArgs(c, host, serviceAccountJSON)
 }
 
 // git returns an *exec.Cmd for a git command, with Stderr redirected.
-func git(workDir string, args ...string) *ctxcmd.CtxCmd {
-	cmd := exec.Command("git", args...)
+// authArgs, if given, are inserted before args as global git arguments
+// (e.g. "-c http.extraHeader=...").
+func git(workDir string, authArgs []string, args ...string) *ctxcmd.CtxCmd {
+	fullArgs := append(append([]string{}, authArgs...), args...)
+	cmd := exec.Command("git", fullArgs...)
 	if workDir != "" {
 		cmd.Dir = workDir
 	}
@@ -96,9 +120,28 @@ func git(workDir string, args ...string) *ctxcmd.CtxCmd {
 	return &ctxcmd.CtxCmd{Cmd: cmd}
 }
 
+// printableGitCommand renders a "git <authArgs> <args>" command line for
+// logging, redacting any credentials injected via authArgs (gitAuthArgs
+// stuffs tokens, Basic auth or cookies into "-c http.extraHeader=...") so
+// they never end up in build logs.
+func printableGitCommand(authArgs, args []string) string {
+	parts := make([]string, 0, 1+len(authArgs)+len(args))
+	parts = append(parts, "git")
+	for i := 0; i < len(authArgs); i++ {
+		if authArgs[i] == "-c" && i+1 < len(authArgs) && strings.HasPrefix(authArgs[i+1], "http.extraHeader=") {
+			parts = append(parts, "-c", "http.extraHeader=<redacted>")
+			i++
+			continue
+		}
+		parts = append(parts, authArgs[i])
+	}
+	parts = append(parts, args...)
+	return strings.Join(parts, " ")
+}
+
 // runGit prints the git command, runs it, redirects Stdout and Stderr and returns an error.
-func runGit(c context.Context, workDir string, args ...string) error {
-	cmd := git(workDir, args...)
+func runGit(c context.Context, workDir string, authArgs []string, args ...string) error {
+	cmd := git(workDir, authArgs, args...)
 	if workDir != "" {
 		absWorkDir, err := filepath.Abs(workDir)
 		if err != nil {
@@ -106,7 +149,7 @@ func runGit(c context.Context, workDir string, args ...string) error {
 		}
 		fmt.Print(absWorkDir)
 	}
-	fmt.Printf("$ %s\n", strings.Join(cmd.Args, " "))
+	fmt.Printf("$ %s\n", printableGitCommand(authArgs, args))
 	cmd.Stdout = os.Stdout
 	return cmd.Run(c)
 }
@@ -0,0 +1,247 @@
+// Copyright (c) 2016 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/golang/go/src/io/ioutil"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// integrationManifest is the subset of a Gitiles-hosted "integration
+// manifest" that cook cares about: where the recipes live and which
+// revision of them is pinned.
+type integrationManifest struct {
+	RecipesRepository string `json:"recipes_repository"`
+	Revision          string `json:"revision"`
+}
+
+// gerritChangeInfo is the subset of a Gerrit ChangeInfo that cook needs to
+// resolve a CL to a ref and revision to bootstrap from.
+type gerritChangeInfo struct {
+	Branch          string `json:"branch"`
+	CurrentRevision string `json:"current_revision"`
+}
+
+// buildbucketBuild is the subset of a buildbucket Build message that cook
+// cares about: the pinned gitiles commit of the build's input, if any.
+type buildbucketBuild struct {
+	Input struct {
+		GitilesCommit *gitilesCommit `json:"gitiles_commit"`
+	} `json:"input"`
+}
+
+// gitilesCommit identifies a single commit in a Gitiles-hosted repository.
+type gitilesCommit struct {
+	Host    string `json:"host"`
+	Project string `json:"project"`
+	Ref     string `json:"ref"`
+	ID      string `json:"id"`
+}
+
+// gerritChangePrefix is prepended by Gerrit to every JSON response to guard
+// against cross-site script inclusion; it must be stripped before parsing.
+var gerritChangePrefix = []byte(")]}'\n")
+
+// fetchGitilesManifest fetches and parses an integration manifest file from
+// a Gitiles-hosted repository at the given ref, using the Gitiles REST API's
+// base64-encoded text format.
+func fetchGitilesManifest(c context.Context, remote, ref, manifestPath string) (*integrationManifest, error) {
+	u := fmt.Sprintf("%s/+/%s/%s?format=TEXT", strings.TrimRight(remote, "/"), ref, manifestPath)
+	resp, err := ctxhttp.Get(c, http.DefaultClient, u)
+	if err != nil {
+		return nil, fmt.Errorf("fetching integration manifest %q: %s", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching integration manifest %q: HTTP %d", u, resp.StatusCode)
+	}
+
+	encoded, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading integration manifest %q: %s", u, err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decoding integration manifest %q: %s", u, err)
+	}
+
+	manifest := &integrationManifest{}
+	if err := json.Unmarshal(decoded, manifest); err != nil {
+		return nil, fmt.Errorf("parsing integration manifest %q: %s", u, err)
+	}
+	if manifest.RecipesRepository == "" {
+		return nil, fmt.Errorf("integration manifest %q has no recipes_repository", u)
+	}
+	return manifest, nil
+}
+
+// resolveGerritChange queries Gerrit for a change's target ref and current
+// revision, so cook can bootstrap the integration manifest as it will look
+// once the change lands.
+func resolveGerritChange(c context.Context, gerritHost string, changeNumber int) (ref, revision string, err error) {
+	u := fmt.Sprintf("https://%s/changes/%d/detail?o=CURRENT_REVISION", gerritHost, changeNumber)
+	resp, err := ctxhttp.Get(c, http.DefaultClient, u)
+	if err != nil {
+		return "", "", fmt.Errorf("fetching Gerrit change %q: %s", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("fetching Gerrit change %q: HTTP %d", u, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", "", fmt.Errorf("reading Gerrit change %q: %s", u, err)
+	}
+	body = bytes.TrimPrefix(body, gerritChangePrefix)
+
+	info := &gerritChangeInfo{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return "", "", fmt.Errorf("parsing Gerrit change %q: %s", u, err)
+	}
+	if info.CurrentRevision == "" {
+		return "", "", fmt.Errorf("Gerrit change %q has no current revision", u)
+	}
+	return "refs/heads/" + info.Branch, info.CurrentRevision, nil
+}
+
+// fetchGerritFileManifest fetches and parses an integration manifest as it
+// reads at a specific Gerrit change revision, via Gerrit's file-content API.
+// Unlike fetchGitilesManifest, this sees in-flight edits to the manifest
+// made by the CL itself, rather than its target branch's landed state.
+func fetchGerritFileManifest(c context.Context, gerritHost string, changeNumber int, revision, manifestPath string) (*integrationManifest, error) {
+	segments := strings.Split(manifestPath, "/")
+	for i, s := range segments {
+		segments[i] = url.QueryEscape(s)
+	}
+	fileID := strings.Join(segments, "%2F")
+	u := fmt.Sprintf("https://%s/changes/%d/revisions/%s/files/%s/content", gerritHost, changeNumber, revision, fileID)
+	resp, err := ctxhttp.Get(c, http.DefaultClient, u)
+	if err != nil {
+		return nil, fmt.Errorf("fetching integration manifest %q: %s", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching integration manifest %q: HTTP %d", u, resp.StatusCode)
+	}
+
+	encoded, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading integration manifest %q: %s", u, err)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(string(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("decoding integration manifest %q: %s", u, err)
+	}
+
+	manifest := &integrationManifest{}
+	if err := json.Unmarshal(decoded, manifest); err != nil {
+		return nil, fmt.Errorf("parsing integration manifest %q: %s", u, err)
+	}
+	if manifest.RecipesRepository == "" {
+		return nil, fmt.Errorf("integration manifest %q has no recipes_repository", u)
+	}
+	return manifest, nil
+}
+
+// parseGerritChangeURL splits a "-cl" flag value of the form
+// "https://host/c/project/+/1234" or "host:1234" into a host and change
+// number.
+func parseGerritChangeURL(cl string) (host string, changeNumber int, err error) {
+	cl = strings.TrimPrefix(cl, "https://")
+	cl = strings.TrimPrefix(cl, "http://")
+	slash := strings.IndexByte(cl, '/')
+	colon := strings.IndexByte(cl, ':')
+	sep := slash
+	if sep < 0 || (colon >= 0 && colon < sep) {
+		sep = colon
+	}
+	if sep < 0 {
+		return "", 0, fmt.Errorf("invalid -cl %q: expected host/...change-number or host:change-number", cl)
+	}
+	host = cl[:sep]
+
+	numberStr := cl
+	if i := strings.LastIndexByte(cl, '/'); i >= 0 {
+		numberStr = cl[i+1:]
+	} else if i := strings.LastIndexByte(cl, ':'); i >= 0 {
+		numberStr = cl[i+1:]
+	}
+	changeNumber, err = strconv.Atoi(numberStr)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid -cl %q: no change number: %s", cl, err)
+	}
+	return host, changeNumber, nil
+}
+
+// loadBuildbucketBuild reads and parses a buildbucket Build message from a
+// JSON file, as passed to cook via "-buildbucket-build".
+func loadBuildbucketBuild(path string) (*buildbucketBuild, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading buildbucket build %q: %s", path, err)
+	}
+	build := &buildbucketBuild{}
+	if err := json.Unmarshal(data, build); err != nil {
+		return nil, fmt.Errorf("parsing buildbucket build %q: %s", path, err)
+	}
+	return build, nil
+}
+
+// resolveIntegration, if an integration remote was configured, bootstraps
+// c.RepositoryURL and c.Revision from the pinned integration manifest
+// rather than requiring the caller to know them up front. A Gerrit CL, if
+// given, takes precedence over -integration-ref: the manifest is read at
+// the CL's own current patchset, so in-flight edits to it are honored
+// rather than only the target branch's landed state. A buildbucket build
+// input, if given, takes precedence over the manifest's own pin.
+func (c *cookRun) resolveIntegration(ctx context.Context) error {
+	if c.IntegrationRemote == "" {
+		return nil
+	}
+
+	var manifest *integrationManifest
+	var err error
+	if c.CL != "" {
+		host, changeNumber, parseErr := parseGerritChangeURL(c.CL)
+		if parseErr != nil {
+			return parseErr
+		}
+		_, revision, resolveErr := resolveGerritChange(ctx, host, changeNumber)
+		if resolveErr != nil {
+			return resolveErr
+		}
+		manifest, err = fetchGerritFileManifest(ctx, host, changeNumber, revision, c.ManifestPath)
+	} else {
+		manifest, err = fetchGitilesManifest(ctx, c.IntegrationRemote, c.IntegrationRef, c.ManifestPath)
+	}
+	if err != nil {
+		return err
+	}
+	c.RepositoryURL = manifest.RecipesRepository
+	c.Revision = manifest.Revision
+
+	if c.BuildbucketBuild != "" {
+		build, err := loadBuildbucketBuild(c.BuildbucketBuild)
+		if err != nil {
+			return err
+		}
+		if commit := build.Input.GitilesCommit; commit != nil {
+			c.RepositoryURL = fmt.Sprintf("https://%s/%s", commit.Host, commit.Project)
+			c.Revision = commit.ID
+		}
+	}
+	return nil
+}
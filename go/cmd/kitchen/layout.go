@@ -0,0 +1,157 @@
+// Copyright (c) 2016 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/golang/go/src/io/ioutil"
+	"github.com/golang/go/src/path/filepath"
+	"golang.org/x/net/context"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// layoutSource describes one file or glob to copy from a layout entry's
+// checked-out repository into the recipe's working tree. Exactly one of
+// DstDir or DstFile should be set: DstDir copies every match by its
+// basename into that directory, DstFile renames a single match to that
+// path.
+type layoutSource struct {
+	Src     string `json:"src" yaml:"src"`
+	DstDir  string `json:"dstDir,omitempty" yaml:"dstDir,omitempty"`
+	DstFile string `json:"dstFile,omitempty" yaml:"dstFile,omitempty"`
+}
+
+// layoutEntry describes a single upstream repository, pinned to a revision,
+// and the files to copy from it into the recipe's working tree.
+type layoutEntry struct {
+	Repo    string         `json:"repo" yaml:"repo"`
+	Version string         `json:"version" yaml:"version"`
+	Sources []layoutSource `json:"sources" yaml:"sources"`
+}
+
+// layout is the top-level -layout file format: a list of repositories to
+// assemble into the recipe's working tree before it runs.
+type layout struct {
+	Entries []layoutEntry `json:"entries" yaml:"entries"`
+}
+
+// loadLayout reads and parses a -layout file. The format may be YAML or
+// JSON, since JSON is a subset of YAML.
+func loadLayout(path string) (*layout, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading layout %q: %s", path, err)
+	}
+	l := &layout{}
+	if err := yaml.Unmarshal(data, l); err != nil {
+		return nil, fmt.Errorf("parsing layout %q: %s", path, err)
+	}
+	return l, nil
+}
+
+// cacheKeyForRepo derives a filesystem-safe cache directory name from a
+// repository URL, so repeated cook invocations reuse the same clone
+// instead of re-cloning every layout entry from scratch.
+func cacheKeyForRepo(repoURL string) string {
+	sum := sha256.Sum256([]byte(repoURL))
+	return hex.EncodeToString(sum[:])
+}
+
+// checkoutLayoutEntry clones or fetches entry.Repo into a subdirectory of
+// cacheDir keyed by its URL, checks out entry.Version, then copies each of
+// its sources into destDir.
+func checkoutLayoutEntry(c context.Context, cacheDir, destDir, serviceAccountJSON string, entry layoutEntry) error {
+	repoDir := filepath.Join(cacheDir, cacheKeyForRepo(entry.Repo))
+	if err := checkoutRepository(c, repoDir, entry.Repo, entry.Version, serviceAccountJSON); err != nil {
+		return fmt.Errorf("checking out layout entry %q: %s", entry.Repo, err)
+	}
+	for _, src := range entry.Sources {
+		if err := copyLayoutSource(repoDir, destDir, src); err != nil {
+			return fmt.Errorf("copying %q from %q: %s", src.Src, entry.Repo, err)
+		}
+	}
+	return nil
+}
+
+// copyLayoutSource expands src.Src as a glob relative to repoDir and copies
+// every match into destDir, per src's DstDir/DstFile.
+func copyLayoutSource(repoDir, destDir string, src layoutSource) error {
+	matches, err := filepath.Glob(filepath.Join(repoDir, src.Src))
+	if err != nil {
+		return fmt.Errorf("invalid glob %q: %s", src.Src, err)
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("glob %q matched no files", src.Src)
+	}
+
+	switch {
+	case src.DstFile != "":
+		if len(matches) != 1 {
+			return fmt.Errorf("dstFile %q requires exactly one match for %q, got %d", src.DstFile, src.Src, len(matches))
+		}
+		return copyFile(matches[0], filepath.Join(destDir, src.DstFile))
+
+	case src.DstDir != "":
+		for _, match := range matches {
+			if err := copyFile(match, filepath.Join(destDir, src.DstDir, filepath.Base(match))); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("source %q has neither dstDir nor dstFile", src.Src)
+	}
+}
+
+// copyFile copies the file at src to dst, creating dst's parent directories
+// and preserving src's mode.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// applyLayout loads c.Layout, if set, and checks out and copies each of its
+// entries into c.CheckoutDir.
+func (c *cookRun) applyLayout(ctx context.Context) error {
+	if c.Layout == "" {
+		return nil
+	}
+	l, err := loadLayout(c.Layout)
+	if err != nil {
+		return err
+	}
+	for _, entry := range l.Entries {
+		if err := checkoutLayoutEntry(ctx, c.LayoutCacheDir, c.CheckoutDir, c.ServiceAccountJSON, entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2016 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/golang/go/src/io/ioutil"
+	"github.com/golang/go/src/path/filepath"
+	"github.com/luci/luci-go/common/ctxcmd"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// RepoClient fetches a repository, or an equivalent packaged artifact, into
+// dst at ref, returning the revision that was checked out. Implementations
+// that cannot resolve a concrete revision return a placeholder instead:
+// localRepoClient returns "local", and cipdRepoClient returns the requested
+// version if cipd reports no instance for the package. dst is created if it
+// doesn't already exist.
+type RepoClient interface {
+	Fetch(c context.Context, dst, ref string) (resolvedRev string, err error)
+}
+
+// newRepoClient selects a RepoClient implementation by repoURL's scheme:
+//
+//	git+https://, git+ssh://, or no recognized scheme -> git clone/fetch
+//	gitiles://host/project                            -> Gitiles tarball archive
+//	cipd://package/path                                -> CIPD package
+//	file:///local/path                                 -> local path, no copy
+//
+// The git implementation is the default for backwards compatibility with
+// plain repository URLs.
+func newRepoClient(repoURL, serviceAccountJSON string) (RepoClient, error) {
+	u, err := url.Parse(repoURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository %q: %s", repoURL, err)
+	}
+
+	switch u.Scheme {
+	case "cipd":
+		return &cipdRepoClient{pkg: u.Host + u.Path, serviceAccountJSON: serviceAccountJSON}, nil
+
+	case "gitiles":
+		return &gitilesArchiveRepoClient{repo: "https://" + u.Host + u.Path, serviceAccountJSON: serviceAccountJSON}, nil
+
+	case "file":
+		return &localRepoClient{path: u.Path}, nil
+
+	case "git+https", "git+ssh":
+		return &gitRepoClient{
+			repoURL:            strings.TrimPrefix(u.Scheme, "git+") + "://" + u.Host + u.Path,
+			serviceAccountJSON: serviceAccountJSON,
+		}, nil
+
+	default:
+		return &gitRepoClient{repoURL: repoURL, serviceAccountJSON: serviceAccountJSON}, nil
+	}
+}
+
+// gitRepoClient is the RepoClient that clones or fetches a git repository,
+// as cook has always done.
+type gitRepoClient struct {
+	repoURL            string
+	serviceAccountJSON string
+}
+
+func (g *gitRepoClient) Fetch(c context.Context, dst, ref string) (string, error) {
+	if err := checkoutRepository(c, dst, g.repoURL, ref, g.serviceAccountJSON); err != nil {
+		return "", err
+	}
+	out, err := git(dst, nil, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("resolving HEAD of %q: %s", dst, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitilesArchiveRepoClient fetches a Gitiles "+archive" tarball of a single
+// revision, which is much cheaper than a full clone for a one-shot build
+// that doesn't need git history.
+type gitilesArchiveRepoClient struct {
+	repo               string // e.g. "https://chromium.googlesource.com/chromium/src"
+	serviceAccountJSON string
+}
+
+// authHeader mints an "Authorization" header value from serviceAccountJSON,
+// or "" if none was configured.
+func (g *gitilesArchiveRepoClient) authHeader(c context.Context) (string, error) {
+	if g.serviceAccountJSON == "" {
+		return "", nil
+	}
+	token, err := mintServiceAccountToken(c, g.serviceAccountJSON)
+	if err != nil {
+		return "", fmt.Errorf("minting service account token: %s", err)
+	}
+	return "Bearer " + token, nil
+}
+
+func (g *gitilesArchiveRepoClient) Fetch(c context.Context, dst, ref string) (string, error) {
+	if ref == "" {
+		ref = "refs/heads/master"
+	}
+	auth, err := g.authHeader(c)
+	if err != nil {
+		return "", err
+	}
+
+	rev, err := resolveGitilesRevision(c, g.repo, ref, auth)
+	if err != nil {
+		return "", err
+	}
+
+	u := fmt.Sprintf("%s/+archive/%s.tar.gz", strings.TrimRight(g.repo, "/"), rev)
+	resp, err := getWithAuth(c, u, auth)
+	if err != nil {
+		return "", fmt.Errorf("fetching archive %q: %s", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching archive %q: HTTP %d", u, resp.StatusCode)
+	}
+
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("decompressing archive %q: %s", u, err)
+	}
+	defer gz.Close()
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return "", err
+	}
+	if err := extractTar(tar.NewReader(gz), dst); err != nil {
+		return "", fmt.Errorf("extracting archive %q: %s", u, err)
+	}
+	return rev, nil
+}
+
+// getWithAuth issues an HTTP GET, attaching authHeader as the Authorization
+// header if it is non-empty.
+func getWithAuth(c context.Context, u, authHeader string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if authHeader != "" {
+		req.Header.Set("Authorization", authHeader)
+	}
+	return ctxhttp.Do(c, http.DefaultClient, req)
+}
+
+// resolveGitilesRevision resolves ref to the full commit hash it currently
+// points at, via the Gitiles +log REST API.
+func resolveGitilesRevision(c context.Context, repo, ref, authHeader string) (string, error) {
+	u := fmt.Sprintf("%s/+log/%s?n=1&format=JSON", strings.TrimRight(repo, "/"), ref)
+	resp, err := getWithAuth(c, u, authHeader)
+	if err != nil {
+		return "", fmt.Errorf("resolving ref %q: %s", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("resolving ref %q: HTTP %d", u, resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("reading ref %q: %s", u, err)
+	}
+	body = bytes.TrimPrefix(body, gerritChangePrefix)
+
+	var log struct {
+		Log []struct {
+			Commit string `json:"commit"`
+		} `json:"log"`
+	}
+	if err := json.Unmarshal(body, &log); err != nil {
+		return "", fmt.Errorf("parsing ref %q: %s", u, err)
+	}
+	if len(log.Log) == 0 {
+		return "", fmt.Errorf("ref %q has no commits", u)
+	}
+	return log.Log[0].Commit, nil
+}
+
+// extractTar extracts every regular file and directory in tr into dst,
+// rejecting any entry (e.g. one with ".." path segments) whose resolved path
+// would land outside dst. An absolute entry name is placed relative to dst.
+func extractTar(tr *tar.Reader, dst string) error {
+	cleanDst := filepath.Clean(dst)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dst, header.Name)
+		if path != cleanDst && !strings.HasPrefix(path, cleanDst+string(os.PathSeparator)) {
+			return fmt.Errorf("tar entry %q escapes destination %q", header.Name, dst)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(path, os.FileMode(header.Mode)); err != nil {
+				return err
+			}
+
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			out.Close()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// cipdRepoClient fetches a CIPD package by shelling out to the `cipd`
+// client binary, mirroring how git.go shells out to `git`.
+type cipdRepoClient struct {
+	pkg                string // CIPD package path, e.g. "infra/recipe_bundles/..."
+	serviceAccountJSON string
+}
+
+func (p *cipdRepoClient) Fetch(c context.Context, dst, ref string) (string, error) {
+	version := ref
+	if version == "" {
+		version = "latest"
+	}
+
+	ensureFile, err := ioutil.TempFile("", "kitchen-cipd-ensure-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(ensureFile.Name())
+	fmt.Fprintf(ensureFile, "%s %s\n", p.pkg, version)
+	if err := ensureFile.Close(); err != nil {
+		return "", err
+	}
+
+	jsonOutput, err := ioutil.TempFile("", "kitchen-cipd-output-")
+	if err != nil {
+		return "", err
+	}
+	jsonOutput.Close()
+	defer os.Remove(jsonOutput.Name())
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return "", err
+	}
+
+	cipdArgs := []string{
+		"ensure",
+		"-root", dst,
+		"-ensure-file", ensureFile.Name(),
+		"-json-output", jsonOutput.Name(),
+	}
+	if p.serviceAccountJSON != "" {
+		cipdArgs = append(cipdArgs, "-service-account-json", p.serviceAccountJSON)
+	}
+	cmd := exec.Command("cipd", cipdArgs...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+	fmt.Printf("$ %s\n", strings.Join(cmd.Args, " "))
+	if err := (&ctxcmd.CtxCmd{Cmd: cmd}).Run(c); err != nil {
+		return "", fmt.Errorf("cipd ensure %q: %s", p.pkg, err)
+	}
+
+	data, err := ioutil.ReadFile(jsonOutput.Name())
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		Result []struct {
+			Package  string `json:"package"`
+			Instance string `json:"instance_id"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return "", fmt.Errorf("parsing cipd output: %s", err)
+	}
+	for _, r := range result.Result {
+		if r.Package == p.pkg {
+			return r.Instance, nil
+		}
+	}
+	return version, nil
+}
+
+// localRepoClient is a pass-through RepoClient for local development: it
+// symlinks dst to an existing local checkout instead of copying anything.
+type localRepoClient struct {
+	path string
+}
+
+func (l *localRepoClient) Fetch(c context.Context, dst, ref string) (string, error) {
+	abs, err := filepath.Abs(l.path)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(abs); err != nil {
+		return "", fmt.Errorf("local repo %q: %s", abs, err)
+	}
+
+	if info, err := os.Lstat(dst); err == nil {
+		if info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Readlink(dst); err == nil && target == abs {
+				return "local", nil
+			}
+		}
+		return "", fmt.Errorf("checkout dir %q already exists and is not a symlink to %q", dst, abs)
+	}
+	if err := os.Symlink(abs, dst); err != nil {
+		return "", err
+	}
+	return "local", nil
+}
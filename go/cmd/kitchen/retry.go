@@ -0,0 +1,98 @@
+// Copyright (c) 2016 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/golang/go/src/path/filepath"
+	"golang.org/x/net/context"
+)
+
+const (
+	retryInitialBackoff = time.Second
+	retryBackoffFactor  = 2
+	retryMaxBackoff     = 30 * time.Second
+	retryMaxAttempts    = 5
+)
+
+// transientGitErrors are substrings of git's stderr output that indicate a
+// network blip rather than a real failure, e.g. a flaky connection to the
+// Git server.
+var transientGitErrors = []string{
+	"early EOF",
+	"Could not resolve host",
+	"RPC failed",
+	"the remote end hung up unexpectedly",
+	"Connection timed out",
+	"Connection reset by peer",
+	"HTTP code 5",
+	"The requested URL returned error: 5",
+}
+
+// isTransientGitError reports whether err, produced by a git subprocess
+// whose stderr was stderr, is likely transient and worth retrying.
+func isTransientGitError(err error, stderr string) bool {
+	if _, ok := err.(*exec.ExitError); !ok {
+		// Not even a process failure (e.g. couldn't start git); not retriable.
+		return false
+	}
+	for _, pattern := range transientGitErrors {
+		if strings.Contains(stderr, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// runGitWithRetry runs a network-touching git command (clone or fetch),
+// retrying with exponential backoff if it fails with a transient error.
+func runGitWithRetry(c context.Context, workDir string, authArgs []string, args ...string) error {
+	backoff := retryInitialBackoff
+	var lastErr error
+	for attempt := 1; attempt <= retryMaxAttempts; attempt++ {
+		if attempt > 1 {
+			fmt.Printf("git command failed, retrying in %s (attempt %d/%d): %s\n", backoff, attempt, retryMaxAttempts, lastErr)
+			select {
+			case <-time.After(backoff):
+			case <-c.Done():
+				return c.Err()
+			}
+			backoff *= retryBackoffFactor
+			if backoff > retryMaxBackoff {
+				backoff = retryMaxBackoff
+			}
+		}
+
+		cmd := git(workDir, authArgs, args...)
+		var stderr bytes.Buffer
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+		if workDir != "" {
+			absWorkDir, err := filepath.Abs(workDir)
+			if err != nil {
+				return err
+			}
+			fmt.Print(absWorkDir)
+		}
+		fmt.Printf("$ %s\n", printableGitCommand(authArgs, args))
+		cmd.Stdout = os.Stdout
+
+		err := cmd.Run(c)
+		if err == nil {
+			return nil
+		}
+		if !isTransientGitError(err, stderr.String()) {
+			return err
+		}
+		lastErr = err
+	}
+	return fmt.Errorf("git command failed after %d attempts: %s", retryMaxAttempts, lastErr)
+}